@@ -2,30 +2,497 @@ package main
 
 import (
 	"bytes"
+	"expvar"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 const VERSION = "0.3.1"
 
+const (
+	// outgoingBufferSize bounds how many parsed packets a destWriter will
+	// queue while its connection is down before it starts dropping them.
+	outgoingBufferSize = 1000
+
+	dialTimeout = time.Second
+	minBackoff  = 500 * time.Millisecond
+	maxBackoff  = 30 * time.Second
+
+	// maxAggregatedPayload bounds how many bytes of newline-joined,
+	// aggregated metric lines go into a single flushed UDP payload, to
+	// stay under typical MTU.
+	maxAggregatedPayload = 1432
+
+	// udpReadDeadline bounds how long udpListener's read loop blocks
+	// before it wakes up to check for a shutdown signal.
+	udpReadDeadline = time.Second
+)
+
+// tagOp is a per-destination tag rewrite: either set (add/overwrite) a
+// tag, or remove one.
+type tagOp struct {
+	Remove bool
+	Key    string
+	Value  string
+}
+
 type Destination struct {
+	Network string // "udp", "tcp", or "unix"; defaults to "udp"
 	Address string
 	Regex   *regexp.Regexp
 	Replace []byte
+
+	// DropTypes holds StatsD type suffixes ("c", "g", "ms", "h", "s") that
+	// this destination doesn't understand and should never receive.
+	DropTypes map[string]bool
+	// TagOps are applied, in order, to a metric's tag set before it is
+	// forwarded to this destination.
+	TagOps []tagOp
+	// RateScale downsamples traffic to a destination that can't handle
+	// full volume: a value below 1.0 makes forDestination actually drop
+	// that complementary fraction of packets (not just relabel them with
+	// a smaller @sample_rate), and scales the @sample_rate of the ones
+	// that do go through so downstream extrapolation stays correct. 1.0
+	// (the zero value is normalized to this) leaves traffic untouched.
+	RateScale float64
+	// Raw opts this destination out of --flush-interval aggregation, so
+	// it still gets every packet unbatched even when other destinations
+	// are being aggregated.
+	Raw bool
+}
+
+// networkSchemes maps the "--destination-address" scheme prefix to the
+// network name passed to net.Dial. Addresses given without a prefix
+// default to "udp" for backwards compatibility.
+var networkSchemes = map[string]string{
+	"udp://":  "udp",
+	"tcp://":  "tcp",
+	"unix://": "unix",
+}
+
+// parseDestination parses a "--destination-address" flag value of the
+// form "[scheme://]host:port:regex:replace[|filter]..." (udp/tcp) or
+// "unix:///path/to.sock:regex:replace[|filter]..." (unix) into a
+// Destination. Supported filters, each its own "|"-separated segment:
+//
+//	drop=h,ms        drop metrics of these StatsD types
+//	rate=0.1         downsample to this fraction of packets and rescale @sample_rate to match
+//	tag+=key:value   set/add a tag
+//	tag-=key         remove a tag
+//	raw              opt out of --flush-interval aggregation
+func parseDestination(s string) (Destination, error) {
+	segments := strings.Split(s, "|")
+	base := segments[0]
+
+	network := "udp"
+	rest := base
+	for scheme, n := range networkSchemes {
+		if strings.HasPrefix(base, scheme) {
+			network = n
+			rest = strings.TrimPrefix(base, scheme)
+			break
+		}
+	}
+
+	parts := strings.Split(rest, ":")
+
+	dest := Destination{Network: network, RateScale: 1.0}
+	if network == "unix" {
+		if len(parts) < 3 {
+			return Destination{}, fmt.Errorf("expected unix:///path:regex:replace")
+		}
+		regex, replace := parts[len(parts)-2], parts[len(parts)-1]
+		dest.Address = strings.Join(parts[:len(parts)-2], ":")
+		dest.Regex = regexp.MustCompile(regex)
+		dest.Replace = []byte(replace)
+	} else {
+		if len(parts) < 4 {
+			return Destination{}, fmt.Errorf("expected [scheme://]host:port:regex:replace")
+		}
+		dest.Address = fmt.Sprintf("%s:%s", parts[0], parts[1])
+		dest.Regex = regexp.MustCompile(parts[2])
+		dest.Replace = []byte(parts[3])
+	}
+
+	for _, filter := range segments[1:] {
+		if err := dest.applyFilter(filter); err != nil {
+			return Destination{}, err
+		}
+	}
+
+	return dest, nil
+}
+
+func (d *Destination) applyFilter(filter string) error {
+	switch {
+	case strings.HasPrefix(filter, "drop="):
+		d.DropTypes = map[string]bool{}
+		for _, t := range strings.Split(strings.TrimPrefix(filter, "drop="), ",") {
+			if t != "" {
+				d.DropTypes[t] = true
+			}
+		}
+	case strings.HasPrefix(filter, "rate="):
+		rate, err := strconv.ParseFloat(strings.TrimPrefix(filter, "rate="), 64)
+		if err != nil || rate <= 0 {
+			return fmt.Errorf("invalid rate filter %q", filter)
+		}
+		d.RateScale = rate
+	case strings.HasPrefix(filter, "tag+="):
+		kv := strings.SplitN(strings.TrimPrefix(filter, "tag+="), ":", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid tag+= filter %q, expected tag+=key:value", filter)
+		}
+		d.TagOps = append(d.TagOps, tagOp{Key: kv[0], Value: kv[1]})
+	case strings.HasPrefix(filter, "tag-="):
+		key := strings.TrimPrefix(filter, "tag-=")
+		d.TagOps = append(d.TagOps, tagOp{Remove: true, Key: key})
+	case filter == "raw":
+		d.Raw = true
+	default:
+		return fmt.Errorf("unrecognized destination filter %q", filter)
+	}
+	return nil
+}
+
+// hashRing consistently routes metric keys to exactly one destination
+// index, using virtual nodes per destination so that adding or removing a
+// destination only remaps ~1/N of keys rather than reshuffling everything.
+// It is built once at startup from the static --destination-address list
+// and never mutated afterwards.
+type hashRing struct {
+	replicas int
+	hashes   []uint32
+	owner    map[uint32]int
+}
+
+func newHashRing(destinations []Destination, replicas int) *hashRing {
+	hashes := make([]uint32, 0, len(destinations)*replicas)
+	owner := make(map[uint32]int, len(destinations)*replicas)
+	for i, dest := range destinations {
+		// Hash the address once, then combine it with each replica index
+		// and run the combination through mixHash's finalizer rather than
+		// hashing "address-N" strings directly: FNV-1a doesn't avalanche
+		// well when every vnode's input shares a long common prefix and
+		// differs only in a small trailing integer, which clumped a
+		// destination's vnodes together on the ring instead of spreading
+		// them out.
+		base := hashKey([]byte(dest.Address))
+		for v := 0; v < replicas; v++ {
+			h := mixHash(base + uint32(v)*vnodeMixConstant)
+			hashes = append(hashes, h)
+			owner[h] = i
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+
+	return &hashRing{replicas: replicas, hashes: hashes, owner: owner}
+}
+
+// Get returns the destination index owning key, or -1 if the ring is
+// empty.
+func (r *hashRing) Get(key []byte) int {
+	if len(r.hashes) == 0 {
+		return -1
+	}
+	h := hashKey(key)
+	idx := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if idx == len(r.hashes) {
+		idx = 0
+	}
+	return r.owner[r.hashes[idx]]
+}
+
+func hashKey(b []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(b)
+	return h.Sum32()
+}
+
+// vnodeMixConstant spreads adjacent replica indices far apart in 32-bit
+// space before mixHash finalizes them (2654435761, the 32-bit golden
+// ratio constant used by Knuth's multiplicative hashing).
+const vnodeMixConstant = 0x9e3779b1
+
+// mixHash is murmur3's 32-bit finalizer: a few xorshift/multiply rounds
+// that give any input thorough avalanche, used to fix up combined hashes
+// that plain FNV-1a doesn't spread well (see newHashRing).
+func mixHash(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// Metric is a single parsed StatsD line:
+// "key:value|type[|@sample_rate][|#tag1:v1,tag2:v2]".
+type Metric struct {
+	Key        []byte
+	Value      []byte
+	Type       []byte
+	SampleRate float64
+	Tags       map[string]string
+}
+
+var metricTypes = map[string]bool{
+	"c":  true, // counter
+	"g":  true, // gauge
+	"ms": true, // timer
+	"h":  true, // histogram
+	"s":  true, // set
+	"d":  true, // distribution (DogStatsD)
+}
+
+// parseMetric parses a single StatsD line. It returns false for anything
+// that isn't a well-formed "key:value|type" line, including the bare
+// "key:value" lines the old packetRegexp silently forwarded.
+func parseMetric(line []byte) (*Metric, bool) {
+	idx := bytes.IndexByte(line, ':')
+	if idx <= 0 || idx == len(line)-1 {
+		return nil, false
+	}
+
+	segments := bytes.Split(line[idx+1:], []byte("|"))
+	if len(segments) < 2 || len(segments[0]) == 0 || !metricTypes[string(segments[1])] {
+		return nil, false
+	}
+
+	m := &Metric{
+		Key:        line[:idx],
+		Value:      segments[0],
+		Type:       segments[1],
+		SampleRate: 1.0,
+	}
+
+	for _, seg := range segments[2:] {
+		if len(seg) == 0 {
+			continue
+		}
+		switch seg[0] {
+		case '@':
+			if rate, err := strconv.ParseFloat(string(seg[1:]), 64); err == nil && rate > 0 {
+				m.SampleRate = rate
+			}
+		case '#':
+			m.Tags = parseTags(seg[1:])
+		}
+	}
+
+	return m, true
+}
+
+func parseTags(b []byte) map[string]string {
+	tags := make(map[string]string)
+	for _, kv := range bytes.Split(b, []byte(",")) {
+		if len(kv) == 0 {
+			continue
+		}
+		parts := bytes.SplitN(kv, []byte(":"), 2)
+		if len(parts) == 2 {
+			tags[string(parts[0])] = string(parts[1])
+		} else {
+			tags[string(parts[0])] = ""
+		}
+	}
+	return tags
+}
+
+// render rebuilds the wire-format StatsD line for a metric, using the
+// given (possibly rewritten) key and tag set.
+func (m *Metric) render(key []byte, sampleRate float64, tags map[string]string) []byte {
+	var buf bytes.Buffer
+	buf.Write(key)
+	buf.WriteByte(':')
+	buf.Write(m.Value)
+	buf.WriteByte('|')
+	buf.Write(m.Type)
+	if sampleRate != 1.0 {
+		fmt.Fprintf(&buf, "|@%s", strconv.FormatFloat(sampleRate, 'g', -1, 64))
+	}
+	if len(tags) > 0 {
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteString("|#")
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(k)
+			if v := tags[k]; v != "" {
+				buf.WriteByte(':')
+				buf.WriteString(v)
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// forDestination applies a destination's tag rewrites and rate scaling,
+// returning the tag set and sample rate to render for that destination,
+// and whether the metric should go to that destination at all. A
+// RateScale below 1.0 makes keep probabilistically false for the
+// complementary fraction of packets, so volume to that destination is
+// actually reduced rather than just relabeled with a smaller
+// @sample_rate that a downstream backend would use to over-extrapolate.
+func (m *Metric) forDestination(dest Destination) (tags map[string]string, sampleRate float64, keep bool) {
+	tags = make(map[string]string, len(m.Tags))
+	for k, v := range m.Tags {
+		tags[k] = v
+	}
+	for _, op := range dest.TagOps {
+		if op.Remove {
+			delete(tags, op.Key)
+		} else {
+			tags[op.Key] = op.Value
+		}
+	}
+
+	sampleRate = m.SampleRate
+	keep = true
+	if dest.RateScale != 0 {
+		sampleRate *= dest.RateScale
+		if dest.RateScale < 1.0 {
+			keep = rand.Float64() < dest.RateScale
+		}
+	}
+
+	return tags, sampleRate, keep
+}
+
+// aggregatableTypes holds the StatsD types that can be meaningfully
+// combined across a flush interval: counters are summed, gauges keep
+// the last value seen. Timers, histograms, sets and distributions need
+// every sample (for percentiles, uniqueness, etc.) so they always bypass
+// the aggregator.
+var aggregatableTypes = map[string]bool{
+	"c": true,
+	"g": true,
+}
+
+// aggEntry accumulates one destination-local series (key + type + tag
+// set) across a flush interval.
+type aggEntry struct {
+	Key   []byte
+	Type  []byte
+	Tags  map[string]string
+	Value float64
+}
+
+func (e *aggEntry) render() []byte {
+	var buf bytes.Buffer
+	buf.Write(e.Key)
+	buf.WriteByte(':')
+	buf.WriteString(strconv.FormatFloat(e.Value, 'g', -1, 64))
+	buf.WriteByte('|')
+	buf.Write(e.Type)
+	if len(e.Tags) > 0 {
+		keys := make([]string, 0, len(e.Tags))
+		for k := range e.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteString("|#")
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(k)
+			if v := e.Tags[k]; v != "" {
+				buf.WriteByte(':')
+				buf.WriteString(v)
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// aggregator sums counters and tracks last-value gauges per series for
+// one destination between flushes.
+type aggregator struct {
+	mu      sync.Mutex
+	entries map[string]*aggEntry
+}
+
+func newAggregator() *aggregator {
+	return &aggregator{entries: map[string]*aggEntry{}}
+}
+
+// Add folds a metric's value into its series' accumulator: summed for
+// counters, overwritten for gauges.
+func (a *aggregator) Add(key []byte, mtype []byte, tags map[string]string, value float64) {
+	seriesKey := aggSeriesKey(key, mtype, tags)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e, ok := a.entries[seriesKey]
+	if !ok {
+		e = &aggEntry{
+			Key:  append([]byte(nil), key...),
+			Type: append([]byte(nil), mtype...),
+			Tags: tags,
+		}
+		a.entries[seriesKey] = e
+	}
+	if string(mtype) == "c" {
+		e.Value += value
+	} else {
+		e.Value = value
+	}
 }
 
-type Packet struct {
-	Key  []byte
-	Body []byte
+// Flush returns and clears all accumulated entries.
+func (a *aggregator) Flush() []*aggEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entries := make([]*aggEntry, 0, len(a.entries))
+	for _, e := range a.entries {
+		entries = append(entries, e)
+	}
+	a.entries = map[string]*aggEntry{}
+	return entries
+}
+
+func aggSeriesKey(key []byte, mtype []byte, tags map[string]string) string {
+	tagKeys := make([]string, 0, len(tags))
+	for k := range tags {
+		tagKeys = append(tagKeys, k)
+	}
+	sort.Strings(tagKeys)
+
+	var buf bytes.Buffer
+	buf.Write(key)
+	buf.WriteByte('|')
+	buf.Write(mtype)
+	for _, k := range tagKeys {
+		buf.WriteByte('|')
+		buf.WriteString(k)
+		buf.WriteByte(':')
+		buf.WriteString(tags[k])
+	}
+	return buf.String()
 }
 
 type StringArray []string
@@ -41,71 +508,279 @@ func (a *StringArray) String() string {
 
 var (
 	address              = flag.String("address", ":8125", "UDP listening address")
+	adminAddress         = flag.String("admin-address", "", "admin HTTP address for /metrics and /debug/vars (disabled if empty)")
 	destinationAddresses = StringArray{}
 	showVersion          = flag.Bool("version", false, "print version info")
+	mode                 = flag.String("mode", "broadcast", "destination mode: broadcast (send every metric to every destination) or shard (consistent-hash route each metric to exactly one destination)")
+	hashReplicas         = flag.Int("hash-replicas", 160, "virtual nodes per destination on the consistent-hash ring, used in --mode=shard")
+	flushInterval        = flag.Duration("flush-interval", 0, "if > 0, sum counters and keep last-value gauges per destination and flush batched UDP payloads on this interval instead of forwarding every packet (timers/histograms are always forwarded unaggregated; 0 disables aggregation)")
+	maxPacketSize        = flag.Int("max-packet-size", 8192, "maximum UDP packet size to read; the old hardcoded 512B truncates larger DogStatsD batches")
 )
 
+// packetPool recycles the read buffers handed from udpListener to
+// processData, sized to --max-packet-size, so steady-state traffic
+// doesn't allocate one []byte per packet.
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, *maxPacketSize)
+	},
+}
+
+// udpPacket pairs a pool-owned read buffer with the number of valid
+// bytes in it, so processData can return the buffer to packetPool once
+// it's done parsing out of it.
+type udpPacket struct {
+	buf []byte
+	n   int
+}
+
 func init() {
-	flag.Var(&destinationAddresses, "destination-address", "destination address (may be given multiple times)")
+	flag.Var(&destinationAddresses, "destination-address", "destination address as [udp|tcp|unix]://host:port:regex:replace, udp:// assumed if no scheme given (may be given multiple times)")
 }
 
-var packetRegexp = regexp.MustCompile("^([^:]+):(.*)$")
+// destWriter owns the outgoing connection for a single destination. It
+// runs in its own goroutine so a slow or down destination never blocks
+// the others: writes are handed off over a bounded channel. A failed dial
+// or write drops the packet being sent and closes the connection; the next
+// packet re-dials, and a failed dial sleeps with exponential backoff
+// before the one after it tries again, rather than re-dialing inline (the
+// old behavior for UDP) or dying with log.Fatalf (as a naive TCP port
+// would).
+type destWriter struct {
+	dest     Destination
+	msgs     chan []byte
+	agg      *aggregator // nil unless --flush-interval is set and dest didn't opt out with "raw"
+	counters destCounters
 
-func parseMessage(data []byte) []*Packet {
-	var output []*Packet
-	for _, line := range bytes.Split(data, []byte("\n")) {
-		if len(line) == 0 {
-			continue
-		}
+	stop      chan struct{}
+	flushDone chan struct{} // closed once flushLoop has exited (only used if agg != nil)
+	runDone   chan struct{} // closed once run has drained msgs and closed its connection
+}
 
-		item := packetRegexp.FindSubmatch(line)
-		if len(item) == 0 {
-			continue
+// destCounters holds the atomic counters for a single destination, so
+// operators can tell from /metrics or /debug/vars which destination is
+// erroring, reconnecting, or being throttled instead of only seeing a
+// tee-wide total.
+type destCounters struct {
+	packetsForwarded  int64
+	writeErrors       int64
+	reconnects        int64
+	droppedBufferFull int64
+	droppedRate       int64
+}
+
+func newDestWriter(dest Destination) *destWriter {
+	w := &destWriter{
+		dest:    dest,
+		msgs:    make(chan []byte, outgoingBufferSize),
+		stop:    make(chan struct{}),
+		runDone: make(chan struct{}),
+	}
+	if *flushInterval > 0 && !dest.Raw {
+		w.agg = newAggregator()
+		w.flushDone = make(chan struct{})
+		go w.flushLoop(*flushInterval)
+	}
+	go w.run()
+	return w
+}
+
+// Close stops aggregation (flushing whatever was pending) and then closes
+// msgs so run drains any queued packets and closes its connection. It
+// blocks until both have finished, so callers can rely on the
+// destination's connection being closed when Close returns.
+func (w *destWriter) Close() {
+	if w.agg != nil {
+		close(w.stop)
+		<-w.flushDone
+	}
+	close(w.msgs)
+	<-w.runDone
+}
+
+// flushLoop periodically drains the aggregator and writes out the
+// batched, newline-joined result, until stop is closed - at which point
+// it flushes once more so pending counters/gauges aren't lost on
+// shutdown.
+func (w *destWriter) flushLoop(interval time.Duration) {
+	defer close(w.flushDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if entries := w.agg.Flush(); len(entries) > 0 {
+				w.writeBatch(entries)
+			}
+		case <-w.stop:
+			if entries := w.agg.Flush(); len(entries) > 0 {
+				w.writeBatch(entries)
+			}
+			return
 		}
+	}
+}
 
-		packet := &Packet{
-			Key:  item[1],
-			Body: item[2],
+// writeBatch renders aggregated entries and packs as many as fit into
+// maxAggregatedPayload per outgoing packet, newline-separated.
+func (w *destWriter) writeBatch(entries []*aggEntry) {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		line := e.render()
+		if buf.Len() > 0 && buf.Len()+1+len(line) > maxAggregatedPayload {
+			w.Write(append([]byte(nil), buf.Bytes()...))
+			buf.Reset()
 		}
-		output = append(output, packet)
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.Write(line)
+	}
+	if buf.Len() > 0 {
+		w.Write(append([]byte(nil), buf.Bytes()...))
 	}
-	return output
 }
 
-func processData(dataCh chan []byte, destinations []Destination) {
-	var destConns []net.Conn
-	for _, destination := range destinations {
-		conn, err := net.DialTimeout("udp", destination.Address, time.Second)
-		if err != nil {
-			log.Fatalf("ERROR: UDP connection failed - %s", err)
+// Write enqueues a packet for delivery, dropping it if the outgoing
+// buffer is full so a stalled destination can't apply backpressure to
+// the rest of the tee.
+func (w *destWriter) Write(packet []byte) {
+	select {
+	case w.msgs <- packet:
+	default:
+		atomic.AddInt64(&w.counters.droppedBufferFull, 1)
+	}
+}
+
+func (w *destWriter) isStream() bool {
+	return w.dest.Network == "tcp" || w.dest.Network == "unix"
+}
+
+func (w *destWriter) dial() (net.Conn, error) {
+	network := w.dest.Network
+	if network == "" {
+		network = "udp"
+	}
+	return net.DialTimeout(network, w.dest.Address, dialTimeout)
+}
+
+func (w *destWriter) run() {
+	var conn net.Conn
+	backoff := minBackoff
+
+	defer func() {
+		if conn != nil {
+			conn.Close()
 		}
-		destConns = append(destConns, conn)
+		close(w.runDone)
+	}()
+
+	for msg := range w.msgs {
+		if conn == nil {
+			c, err := w.dial()
+			if err != nil {
+				log.Printf("ERROR: dialing %s destination %s - %s", w.dest.Network, w.dest.Address, err)
+				atomic.AddInt64(&w.counters.writeErrors, 1)
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+				continue
+			}
+			conn = c
+			backoff = minBackoff
+			atomic.AddInt64(&w.counters.reconnects, 1)
+		}
+
+		if w.isStream() {
+			msg = append(msg, '\n')
+		}
+
+		if _, err := conn.Write(msg); err != nil {
+			log.Printf("ERROR: writing to %s destination %s - %s", w.dest.Network, w.dest.Address, err)
+			atomic.AddInt64(&w.counters.writeErrors, 1)
+			conn.Close()
+			conn = nil
+			continue
+		}
+		atomic.AddInt64(&w.counters.packetsForwarded, 1)
 	}
+}
+
+// processData fans parsed metrics out to destinations. In "broadcast"
+// mode (ring == nil) every destination gets every metric, as before; in
+// "shard" mode each metric is routed to exactly one destination chosen by
+// a consistent hash of its key. It runs until dataCh is closed; the
+// caller closes dataCh only once udpListener has stopped, so processData
+// naturally drains whatever was already queued before it returns and
+// closes every destination's connection.
+func processData(dataCh chan *udpPacket, writers []*destWriter, ring *hashRing) {
+	defer func() {
+		for _, w := range writers {
+			w.Close()
+		}
+	}()
 
 	for data := range dataCh {
-		for _, p := range parseMessage(data) {
-			for i, destination := range destinations {
-				key := destination.Regex.ReplaceAll(p.Key, destination.Replace)
-				packet := fmt.Sprintf("%s:%s", key, p.Body)
-				conn := destConns[i]
-				_, err := conn.Write([]byte(packet))
-				if err != nil {
-					log.Printf("ERROR: writing to UDP socket - %s", err)
-					conn.Close()
-
-					// reconnect
-					conn, err := net.DialTimeout("udp", destination.Address, time.Second)
-					if err != nil {
-						log.Fatalf("ERROR: UDP connection failed - %s", err)
+		atomic.AddInt64(&metrics.packetsReceived, 1)
+		for _, line := range bytes.Split(data.buf[:data.n], []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+
+			metric, ok := parseMetric(line)
+			if !ok {
+				atomic.AddInt64(&metrics.parseErrors, 1)
+				continue
+			}
+			atomic.AddInt64(&metrics.packetsParsed, 1)
+
+			shardTarget := -1
+			if ring != nil {
+				shardTarget = ring.Get(metric.Key)
+			}
+
+			for i, w := range writers {
+				destination := w.dest
+				if ring != nil && i != shardTarget {
+					continue
+				}
+				if destination.DropTypes[string(metric.Type)] {
+					continue
+				}
+				key := destination.Regex.ReplaceAll(metric.Key, destination.Replace)
+				tags, sampleRate, keep := metric.forDestination(destination)
+				if !keep {
+					atomic.AddInt64(&w.counters.droppedRate, 1)
+					continue
+				}
+
+				if w.agg != nil && aggregatableTypes[string(metric.Type)] {
+					value, err := strconv.ParseFloat(string(metric.Value), 64)
+					if err == nil {
+						// sampleRate reflects packets actually forwarded past
+						// the keep check above, so this extrapolates from a
+						// real sample rather than inflating by a rate= factor
+						// that never dropped anything.
+						if string(metric.Type) == "c" && sampleRate > 0 && sampleRate != 1.0 {
+							value /= sampleRate
+						}
+						w.agg.Add(key, metric.Type, tags, value)
+						continue
 					}
-					destConns[i] = conn
 				}
+				w.Write(metric.render(key, sampleRate, tags))
 			}
 		}
+		packetPool.Put(data.buf)
 	}
 }
 
-func udpListener(dataCh chan []byte) {
+// udpListener reads packets until stop is closed. It uses a short read
+// deadline so a closed stop channel is noticed promptly instead of
+// blocking forever in ReadFromUDP with nothing arriving.
+func udpListener(dataCh chan *udpPacket, stop <-chan struct{}) {
 	addr, _ := net.ResolveUDPAddr("udp", *address)
 	log.Printf("listening on %s", addr)
 	listener, err := net.ListenUDP("udp", addr)
@@ -120,15 +795,28 @@ func udpListener(dataCh chan []byte) {
 	}
 
 	for {
-		message := make([]byte, 512)
-		n, remaddr, err := listener.ReadFromUDP(message)
+		select {
+		case <-stop:
+			log.Printf("udp listener shutting down")
+			return
+		default:
+		}
+
+		listener.SetReadDeadline(time.Now().Add(udpReadDeadline))
+
+		buf := packetPool.Get().([]byte)
+		n, remaddr, err := listener.ReadFromUDP(buf)
 		if err != nil {
+			packetPool.Put(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
 			log.Printf("ERROR: reading UDP packet from %+v - %s", remaddr, err)
 			continue
 		}
 
-		log.Printf("msg: %s (%d)", message[:n], n)
-		dataCh <- message[:n]
+		log.Printf("msg: %s (%d)", buf[:n], n)
+		dataCh <- &udpPacket{buf: buf, n: n}
 	}
 }
 
@@ -142,24 +830,165 @@ func main() {
 
 	var destinations []Destination
 	for _, destinationAddress := range destinationAddresses {
-		parts := strings.Split(destinationAddress, ":")
-		destinations = append(destinations, Destination{
-			Address: fmt.Sprintf("%s:%s", parts[0], parts[1]),
-			Regex:   regexp.MustCompile(parts[2]),
-			Replace: []byte(parts[3]),
-		})
+		destination, err := parseDestination(destinationAddress)
+		if err != nil {
+			log.Fatalf("ERROR: invalid --destination-address %q - %s", destinationAddress, err)
+		}
+		destinations = append(destinations, destination)
 	}
 
 	if len(destinations) == 0 {
 		log.Fatalf("must specify at least one --destination-address")
 	}
 
+	var ring *hashRing
+	switch *mode {
+	case "broadcast":
+	case "shard":
+		if *hashReplicas <= 0 {
+			log.Fatalf("ERROR: --hash-replicas must be positive, got %d", *hashReplicas)
+		}
+		ring = newHashRing(destinations, *hashReplicas)
+	default:
+		log.Fatalf("ERROR: invalid --mode %q, must be broadcast or shard", *mode)
+	}
+
+	writers := make([]*destWriter, len(destinations))
+	for i, destination := range destinations {
+		writers[i] = newDestWriter(destination)
+	}
+
+	initMetrics(writers)
+
+	if *adminAddress != "" {
+		go serveAdmin(*adminAddress)
+	}
+
 	runtime.GOMAXPROCS(2)
 
 	signalchan := make(chan os.Signal, 1)
-	signal.Notify(signalchan, syscall.SIGTERM)
+	signal.Notify(signalchan, syscall.SIGTERM, syscall.SIGINT)
+
+	stop := make(chan struct{})
+	listenerDone := make(chan struct{})
+	dataCh := make(chan *udpPacket, 1000)
+	go func() {
+		udpListener(dataCh, stop)
+		close(dataCh)
+		close(listenerDone)
+	}()
+
+	processDone := make(chan struct{})
+	go func() {
+		processData(dataCh, writers, ring)
+		close(processDone)
+	}()
 
-	dataCh := make(chan []byte, 1000)
-	go udpListener(dataCh)
-	processData(dataCh, destinations)
+	sig := <-signalchan
+	log.Printf("received %s, shutting down", sig)
+	close(stop)
+	<-listenerDone
+	<-processDone
+}
+
+// serveAdmin starts the admin HTTP server exposing /metrics in Prometheus
+// text format and /debug/vars via the standard expvar handler, which
+// registers itself on http.DefaultServeMux when the expvar package is
+// imported.
+func serveAdmin(addr string) {
+	log.Printf("admin server listening on %s", addr)
+	http.HandleFunc("/metrics", metricsHandler)
+	if err := http.ListenAndServe(addr, http.DefaultServeMux); err != nil {
+		log.Printf("ERROR: admin server - %s", err)
+	}
+}
+
+// counters holds the atomic packet counters for the tee itself (as
+// opposed to any one destination), so operators can monitor and alert on
+// the tee's health (e.g. parse-error spikes) without relying solely on
+// downstream statsd or log output. Per-destination counters (packets
+// forwarded, write errors, reconnects, dropped packets) live on each
+// destWriter instead, so /metrics and /debug/vars can break those down by
+// destination.
+type counters struct {
+	packetsReceived int64
+	packetsParsed   int64
+	parseErrors     int64
+}
+
+var metrics = &counters{}
+
+// teeWriters is set once by initMetrics so metricsHandler and the expvar
+// publisher can report the live per-destination counters.
+var teeWriters []*destWriter
+
+func initMetrics(writers []*destWriter) {
+	teeWriters = writers
+
+	expvar.Publish("statsdtee", expvar.Func(func() interface{} {
+		destinations := make([]map[string]interface{}, len(teeWriters))
+		for i, w := range teeWriters {
+			destinations[i] = map[string]interface{}{
+				"address":             w.dest.Address,
+				"packets_forwarded":   atomic.LoadInt64(&w.counters.packetsForwarded),
+				"write_errors":        atomic.LoadInt64(&w.counters.writeErrors),
+				"reconnects":          atomic.LoadInt64(&w.counters.reconnects),
+				"dropped_buffer_full": atomic.LoadInt64(&w.counters.droppedBufferFull),
+				"dropped_rate":        atomic.LoadInt64(&w.counters.droppedRate),
+			}
+		}
+		return map[string]interface{}{
+			"packets_received":  atomic.LoadInt64(&metrics.packetsReceived),
+			"packets_parsed":    atomic.LoadInt64(&metrics.packetsParsed),
+			"parse_errors":      atomic.LoadInt64(&metrics.parseErrors),
+			"destination_count": int64(len(teeWriters)),
+			"destinations":      destinations,
+		}
+	}))
+}
+
+// metricsHandler renders the tee-wide and per-destination counters in
+// Prometheus text exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "# HELP statsdtee_packets_received_total UDP packets received by the listener\n")
+	fmt.Fprintf(w, "# TYPE statsdtee_packets_received_total counter\n")
+	fmt.Fprintf(w, "statsdtee_packets_received_total %d\n", atomic.LoadInt64(&metrics.packetsReceived))
+
+	fmt.Fprintf(w, "# HELP statsdtee_packets_parsed_total lines successfully parsed into metrics\n")
+	fmt.Fprintf(w, "# TYPE statsdtee_packets_parsed_total counter\n")
+	fmt.Fprintf(w, "statsdtee_packets_parsed_total %d\n", atomic.LoadInt64(&metrics.packetsParsed))
+
+	fmt.Fprintf(w, "# HELP statsdtee_parse_errors_total lines that failed to parse\n")
+	fmt.Fprintf(w, "# TYPE statsdtee_parse_errors_total counter\n")
+	fmt.Fprintf(w, "statsdtee_parse_errors_total %d\n", atomic.LoadInt64(&metrics.parseErrors))
+
+	fmt.Fprintf(w, "# HELP statsdtee_packets_forwarded_total packets written to a destination\n")
+	fmt.Fprintf(w, "# TYPE statsdtee_packets_forwarded_total counter\n")
+	for _, dw := range teeWriters {
+		fmt.Fprintf(w, "statsdtee_packets_forwarded_total{destination=%q} %d\n", dw.dest.Address, atomic.LoadInt64(&dw.counters.packetsForwarded))
+	}
+
+	fmt.Fprintf(w, "# HELP statsdtee_write_errors_total errors dialing or writing to a destination socket\n")
+	fmt.Fprintf(w, "# TYPE statsdtee_write_errors_total counter\n")
+	for _, dw := range teeWriters {
+		fmt.Fprintf(w, "statsdtee_write_errors_total{destination=%q} %d\n", dw.dest.Address, atomic.LoadInt64(&dw.counters.writeErrors))
+	}
+
+	fmt.Fprintf(w, "# HELP statsdtee_reconnects_total successful connections to a destination, including the first\n")
+	fmt.Fprintf(w, "# TYPE statsdtee_reconnects_total counter\n")
+	for _, dw := range teeWriters {
+		fmt.Fprintf(w, "statsdtee_reconnects_total{destination=%q} %d\n", dw.dest.Address, atomic.LoadInt64(&dw.counters.reconnects))
+	}
+
+	fmt.Fprintf(w, "# HELP statsdtee_dropped_buffer_full_total packets dropped because a destination's outgoing buffer was full\n")
+	fmt.Fprintf(w, "# TYPE statsdtee_dropped_buffer_full_total counter\n")
+	for _, dw := range teeWriters {
+		fmt.Fprintf(w, "statsdtee_dropped_buffer_full_total{destination=%q} %d\n", dw.dest.Address, atomic.LoadInt64(&dw.counters.droppedBufferFull))
+	}
+
+	fmt.Fprintf(w, "# HELP statsdtee_dropped_rate_total packets dropped by a destination's rate= downsampling filter\n")
+	fmt.Fprintf(w, "# TYPE statsdtee_dropped_rate_total counter\n")
+	for _, dw := range teeWriters {
+		fmt.Fprintf(w, "statsdtee_dropped_rate_total{destination=%q} %d\n", dw.dest.Address, atomic.LoadInt64(&dw.counters.droppedRate))
+	}
 }
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseMetric(t *testing.T) {
+	cases := []struct {
+		name string
+		line string
+		ok   bool
+		want *Metric
+	}{
+		{
+			name: "bare counter",
+			line: "foo.bar:1|c",
+			ok:   true,
+			want: &Metric{Key: []byte("foo.bar"), Value: []byte("1"), Type: []byte("c"), SampleRate: 1.0},
+		},
+		{
+			name: "gauge with sample rate and tags",
+			line: "foo.bar:2.5|g|@0.1|#env:prod,region",
+			ok:   true,
+			want: &Metric{
+				Key: []byte("foo.bar"), Value: []byte("2.5"), Type: []byte("g"), SampleRate: 0.1,
+				Tags: map[string]string{"env": "prod", "region": ""},
+			},
+		},
+		{
+			name: "no colon",
+			line: "foo.bar",
+			ok:   false,
+		},
+		{
+			name: "empty key",
+			line: ":1|c",
+			ok:   false,
+		},
+		{
+			name: "empty value",
+			line: "foo.bar:|c",
+			ok:   false,
+		},
+		{
+			name: "no type",
+			line: "foo.bar:1",
+			ok:   false,
+		},
+		{
+			name: "unknown type",
+			line: "foo.bar:1|bogus",
+			ok:   false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := parseMetric([]byte(c.line))
+			if ok != c.ok {
+				t.Fatalf("parseMetric(%q) ok = %v, want %v", c.line, ok, c.ok)
+			}
+			if !ok {
+				return
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("parseMetric(%q) = %+v, want %+v", c.line, got, c.want)
+			}
+		})
+	}
+}
+
+func TestAggregatorAddFlush(t *testing.T) {
+	a := newAggregator()
+
+	a.Add([]byte("req.count"), []byte("c"), map[string]string{"env": "prod"}, 1)
+	a.Add([]byte("req.count"), []byte("c"), map[string]string{"env": "prod"}, 2)
+	a.Add([]byte("pool.size"), []byte("g"), nil, 5)
+	a.Add([]byte("pool.size"), []byte("g"), nil, 7)
+
+	entries := a.Flush()
+	if len(entries) != 2 {
+		t.Fatalf("Flush returned %d entries, want 2", len(entries))
+	}
+
+	byKey := map[string]*aggEntry{}
+	for _, e := range entries {
+		byKey[string(e.Key)] = e
+	}
+
+	if e := byKey["req.count"]; e == nil || e.Value != 3 {
+		t.Errorf("req.count = %+v, want counter summed to 3", e)
+	}
+	if e := byKey["pool.size"]; e == nil || e.Value != 7 {
+		t.Errorf("pool.size = %+v, want gauge overwritten to 7 (last value wins)", e)
+	}
+
+	if got := a.Flush(); len(got) != 0 {
+		t.Errorf("Flush after Flush returned %d entries, want 0 (should clear accumulated state)", len(got))
+	}
+}
+
+func TestAggregatorAddDistinctTagSets(t *testing.T) {
+	a := newAggregator()
+
+	a.Add([]byte("req.count"), []byte("c"), map[string]string{"env": "prod"}, 1)
+	a.Add([]byte("req.count"), []byte("c"), map[string]string{"env": "staging"}, 1)
+
+	entries := a.Flush()
+	if len(entries) != 2 {
+		t.Fatalf("Flush returned %d entries, want 2 (different tag sets are different series)", len(entries))
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want map[string]string
+	}{
+		{name: "empty", in: "", want: map[string]string{}},
+		{name: "single key-value", in: "env:prod", want: map[string]string{"env": "prod"}},
+		{
+			name: "multiple with a valueless tag",
+			in:   "env:prod,region,shard:3",
+			want: map[string]string{"env": "prod", "region": "", "shard": "3"},
+		},
+		{
+			name: "value containing a colon",
+			in:   "url:http://x",
+			want: map[string]string{"url": "http://x"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := parseTags([]byte(c.in))
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("parseTags(%q) = %+v, want %+v", c.in, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseDestinationFilters(t *testing.T) {
+	t.Run("drop", func(t *testing.T) {
+		dest, err := parseDestination("host:8125:^foo:bar|drop=h,ms")
+		if err != nil {
+			t.Fatalf("parseDestination: %v", err)
+		}
+		if !dest.DropTypes["h"] || !dest.DropTypes["ms"] {
+			t.Errorf("DropTypes = %+v, want h and ms set", dest.DropTypes)
+		}
+		if dest.DropTypes["c"] {
+			t.Errorf("DropTypes = %+v, want c unset", dest.DropTypes)
+		}
+	})
+
+	t.Run("rate", func(t *testing.T) {
+		dest, err := parseDestination("host:8125:^foo:bar|rate=0.25")
+		if err != nil {
+			t.Fatalf("parseDestination: %v", err)
+		}
+		if dest.RateScale != 0.25 {
+			t.Errorf("RateScale = %v, want 0.25", dest.RateScale)
+		}
+	})
+
+	t.Run("rate rejects non-positive", func(t *testing.T) {
+		if _, err := parseDestination("host:8125:^foo:bar|rate=0"); err == nil {
+			t.Error("expected error for rate=0, got nil")
+		}
+		if _, err := parseDestination("host:8125:^foo:bar|rate=-1"); err == nil {
+			t.Error("expected error for rate=-1, got nil")
+		}
+	})
+
+	t.Run("tag add and remove", func(t *testing.T) {
+		dest, err := parseDestination("host:8125:^foo:bar|tag+=env:prod|tag-=secret")
+		if err != nil {
+			t.Fatalf("parseDestination: %v", err)
+		}
+		want := []tagOp{{Key: "env", Value: "prod"}, {Remove: true, Key: "secret"}}
+		if !reflect.DeepEqual(dest.TagOps, want) {
+			t.Errorf("TagOps = %+v, want %+v", dest.TagOps, want)
+		}
+	})
+
+	t.Run("raw", func(t *testing.T) {
+		dest, err := parseDestination("host:8125:^foo:bar|raw")
+		if err != nil {
+			t.Fatalf("parseDestination: %v", err)
+		}
+		if !dest.Raw {
+			t.Error("Raw = false, want true")
+		}
+	})
+
+	t.Run("unrecognized filter", func(t *testing.T) {
+		if _, err := parseDestination("host:8125:^foo:bar|bogus=1"); err == nil {
+			t.Error("expected error for unrecognized filter, got nil")
+		}
+	})
+}
+
+func TestForDestinationTagsAndRate(t *testing.T) {
+	m := &Metric{SampleRate: 0.5, Tags: map[string]string{"env": "prod", "secret": "x"}}
+	dest := Destination{
+		RateScale: 1.0,
+		TagOps:    []tagOp{{Key: "region", Value: "us"}, {Remove: true, Key: "secret"}},
+	}
+
+	tags, sampleRate, keep := m.forDestination(dest)
+	if !keep {
+		t.Fatal("keep = false, want true for RateScale 1.0")
+	}
+	if sampleRate != 0.5 {
+		t.Errorf("sampleRate = %v, want 0.5 (unscaled)", sampleRate)
+	}
+	want := map[string]string{"env": "prod", "region": "us"}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags = %+v, want %+v", tags, want)
+	}
+
+	// The original metric's tag set must be untouched by forDestination.
+	if _, ok := m.Tags["region"]; ok {
+		t.Error("forDestination mutated the source metric's Tags map")
+	}
+}
+
+// TestForDestinationActuallyDrops guards against a rate= filter that only
+// rescales @sample_rate without dropping any packets: a destination with
+// rate=0.1 must actually forward roughly 1/10th of traffic, not all of it
+// mislabeled as 10x sampled.
+func TestForDestinationActuallyDrops(t *testing.T) {
+	const rate = 0.1
+	const samples = 100000
+
+	m := &Metric{SampleRate: 1.0}
+	dest := Destination{RateScale: rate}
+
+	kept := 0
+	for i := 0; i < samples; i++ {
+		_, sampleRate, keep := m.forDestination(dest)
+		if keep {
+			kept++
+			if sampleRate != rate {
+				t.Fatalf("sampleRate = %v, want %v for a kept packet", sampleRate, rate)
+			}
+		}
+	}
+
+	got := float64(kept) / float64(samples)
+	if diff := got - rate; diff > 0.02 || diff < -0.02 {
+		t.Errorf("kept fraction = %.3f, want ~%.3f (+/-0.02)", got, rate)
+	}
+}
+
+// TestAggregatorExtrapolationWithRateDrop guards against the aggregation
+// path compounding a fabricated rate= factor: once forDestination actually
+// drops the complementary fraction of packets, dividing each kept counter
+// value by the same sampleRate it reports should extrapolate back to the
+// true total, not inflate it further.
+func TestAggregatorExtrapolationWithRateDrop(t *testing.T) {
+	const rate = 0.2
+	const samples = 50000
+
+	m := &Metric{SampleRate: 1.0}
+	dest := Destination{RateScale: rate}
+	a := newAggregator()
+
+	for i := 0; i < samples; i++ {
+		_, sampleRate, keep := m.forDestination(dest)
+		if !keep {
+			continue
+		}
+		a.Add([]byte("req.count"), []byte("c"), nil, 1/sampleRate)
+	}
+
+	entries := a.Flush()
+	if len(entries) != 1 {
+		t.Fatalf("Flush returned %d entries, want 1", len(entries))
+	}
+
+	got := entries[0].Value
+	if diff := got - samples; diff > samples*0.05 || diff < -samples*0.05 {
+		t.Errorf("extrapolated total = %.0f, want ~%d (+/-5%%)", got, samples)
+	}
+}
+
+// TestHashRingDistribution guards against vnode placement schemes that
+// clump a destination's virtual nodes together on the ring instead of
+// spreading them out (a prior version hashed "address-N" strings, which
+// FNV-1a doesn't avalanche well over, and produced shares as skewed as
+// 9.5%-50% across 3-4 destinations instead of ~1/N each).
+func TestHashRingDistribution(t *testing.T) {
+	const replicas = 160
+	const samples = 100000
+
+	for _, n := range []int{2, 3, 4, 8} {
+		destinations := make([]Destination, n)
+		for i := range destinations {
+			destinations[i] = Destination{Address: fmt.Sprintf("host-%d.internal:8125", i)}
+		}
+		ring := newHashRing(destinations, replicas)
+
+		counts := make([]int, n)
+		for i := 0; i < samples; i++ {
+			key := []byte(fmt.Sprintf("some.metric.key.%d", i))
+			idx := ring.Get(key)
+			if idx < 0 || idx >= n {
+				t.Fatalf("n=%d: Get returned out-of-range index %d", n, idx)
+			}
+			counts[idx]++
+		}
+
+		want := 1.0 / float64(n)
+		for i, c := range counts {
+			got := float64(c) / float64(samples)
+			if diff := got - want; diff > 0.05 || diff < -0.05 {
+				t.Errorf("n=%d: destination %d got share %.3f, want ~%.3f (+/-0.05)", n, i, got, want)
+			}
+		}
+	}
+}